@@ -5,8 +5,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"math"
+	"strconv"
+	"strings"
 	//"os"
-	//"strings"
 
 	"github.com/olivere/elastic"
 
@@ -18,34 +20,55 @@ import (
 	//"github.com/terranodo/tegola/wkb"
 )
 
-type Job struct {
-	Name         string `json:"user"`
-	Location     string `json:"location"`
-	CreatedAt    string `json:"created_at"`
-	UpdatedAt    string `json:"updated_at"`
-	ContractType string `json:"contract_type"`
-	Profession   string `json:"profession"`
-	Category     string `json:"category"`
-}
-
 // layer holds information about a query.
 type layer struct {
 	// The Name of the layer
 	Name string
-	// The SQL to use. !BBOX! token will be replaced by the envelope
+	// SQL holds an optional raw elasticsearch Query DSL template (from the
+	// sql config key). The !BBOX! token is replaced with a JSON fragment
+	// shaped for the layer's geometry_type: a {"top_left":..,"bottom_right":..}
+	// object for geo_point fields, meant to be dropped straight into a
+	// geo_bounding_box query's field body, or an envelope coordinates array
+	// ([[minLon,maxLat],[maxLon,minLat]]) for geo_shape fields, meant for a
+	// geo_shape query's shape.coordinates. Either way the resulting document
+	// is run as a filter alongside the envelope query, letting operators
+	// layer on arbitrary term/range/match clauses without code changes.
 	SQL string
 	// The ID field name, this will default to 'gid' if not set to something other then empty string.
 	IDFieldName string
 	// The Geometery field name, this will default to 'geom' if not set to soemthing other then empty string.
 	GeomFieldName string
+	// GeomFieldType is the elasticsearch mapping type of GeomFieldName, either
+	// GeomTypeGeoPoint (the default) or GeomTypeGeoShape. geo_bounding_box
+	// queries, which the tile envelope filter is built from, only work
+	// against geo_point fields, so geo_shape layers need a different filter.
+	GeomFieldType string
+	// The elasticsearch index to query. This will default to the layer name if not set to something other then empty string.
+	IndexName string
 	// The SRID that the data in the table is stored in. This will default to WebMercator
 	SRID int
+	// Aggregation, when set to AggregationGeohashGrid, switches MVTLayer from fetching
+	// raw hits to a geohash_grid aggregation, suitable for heatmap/cluster tiles at low zoom.
+	Aggregation string
+	// PrecisionByZoom overrides defaultGeohashPrecision for specific zoom levels.
+	PrecisionByZoom map[int]int
+	// GeoBounds, when true, adds a geo_bounds sub-aggregation so each bucket also
+	// carries the bbox polygon of the documents that fell into it.
+	GeoBounds bool
+	// MaxFeatures caps the number of features added to a tile; hits dropped by
+	// SimplifyTolerance do not count toward it. 0 means unlimited, paging
+	// through the full result set via SearchAfter.
+	MaxFeatures int
+	// SimplifyTolerance, in tile pixels, skips features whose bbox is smaller
+	// than that many pixels at the tile's zoom. 0 disables simplification.
+	SimplifyTolerance float64
 }
 
 // Provider provides the elasticsearch data provider.
 type Provider struct {
 	layers map[string]layer // map of layer name and corrosponding sql
 	srid   int
+	client *elastic.Client // cached client shared by all layers
 }
 
 // DEFAULT sql for get geometries,
@@ -61,31 +84,165 @@ const Name = "elasticsearch"
 const DefaultPort = 9200
 const DefaultSRID = tegola.WebMercator
 const DefaultMaxConn = 5
+const DefaultSniff = true
+
+const (
+	ConfigKeyHost              = "host"
+	ConfigKeyPort              = "port"
+	ConfigKeyDB                = "database"
+	ConfigKeyUser              = "user"
+	ConfigKeyPassword          = "password"
+	ConfigKeyMaxConn           = "max_connection"
+	ConfigKeySniff             = "sniff"
+	ConfigKeySRID              = "srid"
+	ConfigKeyLayers            = "layers"
+	ConfigKeyLayerName         = "name"
+	ConfigKeyTablename         = "tablename"
+	ConfigKeySQL               = "sql"
+	ConfigKeyFields            = "fields"
+	ConfigKeyGeomField         = "geometry_fieldname"
+	ConfigKeyGeomFieldType     = "geometry_type"
+	ConfigKeyGeomIDField       = "id_fieldname"
+	ConfigKeyAggregation       = "aggregation"
+	ConfigKeyPrecByZoom        = "precision_by_zoom"
+	ConfigKeyGeoBounds         = "geo_bounds"
+	ConfigKeyMaxFeatures       = "max_features"
+	ConfigKeySimplifyTolerance = "simplify_tolerance"
+)
+
+// DefaultScrollSize is the page size used when paging through a tile's hits
+// via SearchAfter.
+const DefaultScrollSize = 1000
+
+// TilePixels is the assumed tile resolution, in pixels, used to turn
+// simplify_tolerance into a world-unit threshold.
+const TilePixels = 256
+
+// AggregationGeohashGrid is the ConfigKeyAggregation value that switches a layer
+// from raw hits to a geohash_grid bucket aggregation.
+const AggregationGeohashGrid = "geohash_grid"
 
+// GeomTypeGeoPoint and GeomTypeGeoShape are the valid values of
+// ConfigKeyGeomFieldType, identifying how GeomFieldName is mapped in
+// elasticsearch. GeomTypeGeoPoint is the default.
 const (
-	ConfigKeyHost        = "host"
-	ConfigKeyPort        = "port"
-	ConfigKeyDB          = "database"
-	ConfigKeyUser        = "user"
-	ConfigKeyPassword    = "password"
-	ConfigKeyMaxConn     = "max_connection"
-	ConfigKeySRID        = "srid"
-	ConfigKeyLayers      = "layers"
-	ConfigKeyLayerName   = "name"
-	ConfigKeyTablename   = "tablename"
-	ConfigKeySQL         = "sql"
-	ConfigKeyFields      = "fields"
-	ConfigKeyGeomField   = "geometry_fieldname"
-	ConfigKeyGeomIDField = "id_fieldname"
+	GeomTypeGeoPoint = "geo_point"
+	GeomTypeGeoShape = "geo_shape"
 )
 
+// defaultGeohashPrecision maps a tile zoom (0-14, clamped) to a geohash_grid
+// precision, mirroring the z0->p2 ... z14->p8 table typically used to render
+// dense indices as heat/cluster tiles at low zoom.
+var defaultGeohashPrecision = []int{2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 8}
+
+// precisionForZoom returns the geohash_grid precision to use for the given
+// zoom, preferring an explicit override and otherwise falling back to
+// defaultGeohashPrecision.
+func precisionForZoom(z uint64, overrides map[int]int) int {
+	if p, ok := overrides[int(z)]; ok {
+		return p
+	}
+	i := int(z)
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(defaultGeohashPrecision) {
+		i = len(defaultGeohashPrecision) - 1
+	}
+	return defaultGeohashPrecision[i]
+}
+
 func init() {
 	provider.Register(Name, NewProvider)
 }
 
+// boolFromDict reads an optional bool value out of a dict.M, returning def if
+// the key is absent. dict.M itself has no Bool accessor, only String/Int/Uint
+// (and their slice variants), so config keys that are booleans have to be
+// pulled out by hand.
+func boolFromDict(m dict.M, key string, def bool) (bool, error) {
+	v, ok := m[key]
+	if !ok {
+		return def, nil
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("Expected %v to be a bool, got %v", key, v)
+	}
+	return b, nil
+}
+
+// floatFromDict reads an optional float64 value out of a dict.M, returning
+// def if the key is absent. dict.M has no Float accessor, only
+// String/Int/Uint (and their slice variants).
+func floatFromDict(m dict.M, key string, def float64) (float64, error) {
+	v, ok := m[key]
+	if !ok {
+		return def, nil
+	}
+	switch t := v.(type) {
+	case float64:
+		return t, nil
+	case float32:
+		return float64(t), nil
+	case int:
+		return float64(t), nil
+	case int64:
+		return float64(t), nil
+	default:
+		return 0, fmt.Errorf("Expected %v to be a number, got %v", key, v)
+	}
+}
+
 func NewProvider(config map[string]interface{}) (mvt.Provider, error) {
 	c := dict.M(config)
 	p := Provider{}
+
+	defaultHost := "localhost"
+	host, err := c.String(ConfigKeyHost, &defaultHost)
+	if err != nil {
+		return nil, fmt.Errorf("Error while parsing %v: %v", ConfigKeyHost, err)
+	}
+	port := DefaultPort
+	port, err = c.Int(ConfigKeyPort, &port)
+	if err != nil {
+		return nil, fmt.Errorf("Error while parsing %v: %v", ConfigKeyPort, err)
+	}
+	defaultUser := ""
+	user, err := c.String(ConfigKeyUser, &defaultUser)
+	if err != nil {
+		return nil, fmt.Errorf("Error while parsing %v: %v", ConfigKeyUser, err)
+	}
+	defaultPassword := ""
+	password, err := c.String(ConfigKeyPassword, &defaultPassword)
+	if err != nil {
+		return nil, fmt.Errorf("Error while parsing %v: %v", ConfigKeyPassword, err)
+	}
+	maxConn := DefaultMaxConn
+	maxConn, err = c.Int(ConfigKeyMaxConn, &maxConn)
+	if err != nil {
+		return nil, fmt.Errorf("Error while parsing %v: %v", ConfigKeyMaxConn, err)
+	}
+	sniff, err := boolFromDict(c, ConfigKeySniff, DefaultSniff)
+	if err != nil {
+		return nil, fmt.Errorf("Error while parsing %v: %v", ConfigKeySniff, err)
+	}
+
+	opts := []elastic.ClientOptionFunc{
+		elastic.SetURL(fmt.Sprintf("http://%v:%v", host, port)),
+		elastic.SetMaxRetries(maxConn),
+		elastic.SetSniff(sniff),
+	}
+	if user != "" {
+		opts = append(opts, elastic.SetBasicAuth(user, password))
+	}
+
+	client, err := elastic.NewClient(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to elasticsearch at %v:%v : %v", host, port, err)
+	}
+	p.client = client
+
 	layers, ok := c[ConfigKeyLayers].([]map[string]interface{})
 	if !ok {
 		return nil, fmt.Errorf("Expected %v to be a []map[string]interface{}", ConfigKeyLayers)
@@ -119,6 +276,14 @@ func NewProvider(config map[string]interface{}) (mvt.Provider, error) {
 		if idfld == geomfld {
 			return nil, fmt.Errorf("For layer(%v) %v: %v (%v) and %v field (%v) is the same!", i, lname, ConfigKeyGeomField, geomfld, ConfigKeyGeomIDField, idfld)
 		}
+		defaultGeomType := GeomTypeGeoPoint
+		geomType, err := vc.String(ConfigKeyGeomFieldType, &defaultGeomType)
+		if err != nil {
+			return nil, fmt.Errorf("For layer(%v) %v : %v", i, lname, err)
+		}
+		if geomType != GeomTypeGeoPoint && geomType != GeomTypeGeoShape {
+			return nil, fmt.Errorf("For layer(%v) %v: %v must be %v or %v, got %v", i, lname, ConfigKeyGeomFieldType, GeomTypeGeoPoint, GeomTypeGeoShape, geomType)
+		}
 
 		var tblName string
 		tblName, err = vc.String(ConfigKeyTablename, &lname)
@@ -137,10 +302,41 @@ func NewProvider(config map[string]interface{}) (mvt.Provider, error) {
 			log.Printf("Both %v and %v field are specified for layer(%v) %v, using only %[2]v field.", ConfigKeyTablename, ConfigKeySQL, i, lname)
 		}
 
+		var defaultAgg string
+		agg, err := vc.String(ConfigKeyAggregation, &defaultAgg)
+		if err != nil {
+			return nil, fmt.Errorf("for %v layer(%v) %v has an error: %v", i, lname, ConfigKeyAggregation, err)
+		}
+		geoBounds, err := boolFromDict(vc, ConfigKeyGeoBounds, false)
+		if err != nil {
+			return nil, fmt.Errorf("for %v layer(%v) %v has an error: %v", i, lname, ConfigKeyGeoBounds, err)
+		}
+		precByZoom, err := precisionByZoomFromConfig(vc)
+		if err != nil {
+			return nil, fmt.Errorf("for %v layer(%v) %v has an error: %v", i, lname, ConfigKeyPrecByZoom, err)
+		}
+		maxFeatures := 0
+		maxFeatures, err = vc.Int(ConfigKeyMaxFeatures, &maxFeatures)
+		if err != nil {
+			return nil, fmt.Errorf("for %v layer(%v) %v has an error: %v", i, lname, ConfigKeyMaxFeatures, err)
+		}
+		simplifyTolerance, err := floatFromDict(vc, ConfigKeySimplifyTolerance, 0.0)
+		if err != nil {
+			return nil, fmt.Errorf("for %v layer(%v) %v has an error: %v", i, lname, ConfigKeySimplifyTolerance, err)
+		}
+
 		l := layer{
-			Name:          lname,
-			IDFieldName:   idfld,
-			GeomFieldName: geomfld,
+			Name:              lname,
+			SQL:               sql,
+			IDFieldName:       idfld,
+			GeomFieldName:     geomfld,
+			GeomFieldType:     geomType,
+			IndexName:         tblName,
+			Aggregation:       agg,
+			PrecisionByZoom:   precByZoom,
+			GeoBounds:         geoBounds,
+			MaxFeatures:       maxFeatures,
+			SimplifyTolerance: simplifyTolerance,
 		}
 		lyrs[lname] = l
 	}
@@ -149,6 +345,353 @@ func NewProvider(config map[string]interface{}) (mvt.Provider, error) {
 	return p, nil
 }
 
+// geoPointFromValue converts an elasticsearch geo_point value, which can be
+// encoded as a "lat,lon" string, a geohash string, a [lon,lat] array or a
+// {"lat":.., "lon":..} object, into a basic.Point.
+func geoPointFromValue(v interface{}) (basic.Point, error) {
+	switch t := v.(type) {
+	case []interface{}:
+		if len(t) != 2 {
+			return basic.Point{}, fmt.Errorf("Expected a [lon,lat] pair, got %v", t)
+		}
+		lon, ok := t[0].(float64)
+		if !ok {
+			return basic.Point{}, fmt.Errorf("Expected lon to be a number, got %v", t[0])
+		}
+		lat, ok := t[1].(float64)
+		if !ok {
+			return basic.Point{}, fmt.Errorf("Expected lat to be a number, got %v", t[1])
+		}
+		return basic.Point{lon, lat}, nil
+	case map[string]interface{}:
+		lat, ok := t["lat"].(float64)
+		if !ok {
+			return basic.Point{}, fmt.Errorf("Expected lat to be a number, got %v", t["lat"])
+		}
+		lon, ok := t["lon"].(float64)
+		if !ok {
+			return basic.Point{}, fmt.Errorf("Expected lon to be a number, got %v", t["lon"])
+		}
+		return basic.Point{lon, lat}, nil
+	case string:
+		// Either "lat,lon" or a geohash.
+		if lat, lon, ok := parseLatLonString(t); ok {
+			return basic.Point{lon, lat}, nil
+		}
+		lat, lon, err := decodeGeohash(t)
+		if err != nil {
+			return basic.Point{}, fmt.Errorf("Unable to parse geo_point value %v: %v", t, err)
+		}
+		return basic.Point{lon, lat}, nil
+	default:
+		return basic.Point{}, fmt.Errorf("Don't know how to turn %T into a geo_point", v)
+	}
+}
+
+// parseLatLonString attempts to parse a "lat,lon" string, returning ok=false
+// if the value isn't in that form.
+func parseLatLonString(s string) (lat, lon float64, ok bool) {
+	var comma int
+	if comma = indexByte(s, ','); comma < 0 {
+		return 0, 0, false
+	}
+	latStr, lonStr := s[:comma], s[comma+1:]
+	var err error
+	if lat, err = strconv.ParseFloat(latStr, 64); err != nil {
+		return 0, 0, false
+	}
+	if lon, err = strconv.ParseFloat(lonStr, 64); err != nil {
+		return 0, 0, false
+	}
+	return lat, lon, true
+}
+
+func indexByte(s string, b byte) int {
+	for i := 0; i < len(s); i++ {
+		if s[i] == b {
+			return i
+		}
+	}
+	return -1
+}
+
+// geohashAlphabet is the base32 alphabet used by elasticsearch/geohash.org geohashes.
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// decodeGeohash decodes a base32 geohash string into its center lat/lon.
+func decodeGeohash(hash string) (lat, lon float64, err error) {
+	latRange := [2]float64{-90.0, 90.0}
+	lonRange := [2]float64{-180.0, 180.0}
+	even := true
+
+	for i := 0; i < len(hash); i++ {
+		idx := indexByte(geohashAlphabet, hash[i])
+		if idx < 0 {
+			return 0, 0, fmt.Errorf("Invalid geohash character %q in %v", hash[i], hash)
+		}
+		for bit := 4; bit >= 0; bit-- {
+			bitVal := (idx >> uint(bit)) & 1
+			if even {
+				mid := (lonRange[0] + lonRange[1]) / 2
+				if bitVal == 1 {
+					lonRange[0] = mid
+				} else {
+					lonRange[1] = mid
+				}
+			} else {
+				mid := (latRange[0] + latRange[1]) / 2
+				if bitVal == 1 {
+					latRange[0] = mid
+				} else {
+					latRange[1] = mid
+				}
+			}
+			even = !even
+		}
+	}
+	return (latRange[0] + latRange[1]) / 2, (lonRange[0] + lonRange[1]) / 2, nil
+}
+
+// geoShapeFromGeoJSON converts a decoded geo_shape GeoJSON document into a tegola.Geometry.
+func geoShapeFromGeoJSON(m map[string]interface{}) (tegola.Geometry, error) {
+	t, _ := m["type"].(string)
+	coords := m["coordinates"]
+
+	switch t {
+	case "Point":
+		pt, err := coordToPoint(coords)
+		return pt, err
+	case "LineString":
+		return coordsToLine(coords)
+	case "Polygon":
+		return coordsToPolygon(coords)
+	case "MultiPoint":
+		cs, ok := coords.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Expected MultiPoint coordinates to be an array")
+		}
+		mp := make(basic.MultiPoint, 0, len(cs))
+		for _, c := range cs {
+			pt, err := coordToPoint(c)
+			if err != nil {
+				return nil, err
+			}
+			mp = append(mp, pt)
+		}
+		return mp, nil
+	case "MultiLineString":
+		cs, ok := coords.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Expected MultiLineString coordinates to be an array")
+		}
+		ml := make(basic.MultiLine, 0, len(cs))
+		for _, c := range cs {
+			ln, err := coordsToLine(c)
+			if err != nil {
+				return nil, err
+			}
+			ml = append(ml, ln)
+		}
+		return ml, nil
+	case "MultiPolygon":
+		cs, ok := coords.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Expected MultiPolygon coordinates to be an array")
+		}
+		mp := make(basic.MultiPolygon, 0, len(cs))
+		for _, c := range cs {
+			poly, err := coordsToPolygon(c)
+			if err != nil {
+				return nil, err
+			}
+			mp = append(mp, poly)
+		}
+		return mp, nil
+	default:
+		return nil, fmt.Errorf("Don't know how to handle geo_shape type %v", t)
+	}
+}
+
+func coordToPoint(v interface{}) (basic.Point, error) {
+	c, ok := v.([]interface{})
+	if !ok || len(c) < 2 {
+		return basic.Point{}, fmt.Errorf("Expected a [lon,lat] coordinate, got %v", v)
+	}
+	lon, ok := c[0].(float64)
+	if !ok {
+		return basic.Point{}, fmt.Errorf("Expected lon to be a number, got %v", c[0])
+	}
+	lat, ok := c[1].(float64)
+	if !ok {
+		return basic.Point{}, fmt.Errorf("Expected lat to be a number, got %v", c[1])
+	}
+	return basic.Point{lon, lat}, nil
+}
+
+func coordsToLine(v interface{}) (basic.Line, error) {
+	cs, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Expected a line's coordinates to be an array, got %v", v)
+	}
+	ln := make(basic.Line, 0, len(cs))
+	for _, c := range cs {
+		pt, err := coordToPoint(c)
+		if err != nil {
+			return nil, err
+		}
+		ln = append(ln, pt)
+	}
+	return ln, nil
+}
+
+func coordsToPolygon(v interface{}) (basic.Polygon, error) {
+	cs, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Expected a polygon's coordinates to be an array, got %v", v)
+	}
+	poly := make(basic.Polygon, 0, len(cs))
+	for _, c := range cs {
+		ln, err := coordsToLine(c)
+		if err != nil {
+			return nil, err
+		}
+		poly = append(poly, ln)
+	}
+	return poly, nil
+}
+
+// decodeFeature pulls the GeomFieldName out of a hit's _source, converts it
+// to a tegola.Geometry (handling both geo_point and geo_shape encodings),
+// and turns the remaining _source fields into MVT feature tags.
+func decodeFeature(plyr layer, hitID string, source map[string]interface{}, tags map[string]interface{}) (geom tegola.Geometry, id uint64, ftags map[string]interface{}, err error) {
+	geomVal, ok := source[plyr.GeomFieldName]
+	if !ok {
+		return nil, 0, nil, fmt.Errorf("Missing %v field in document %v", plyr.GeomFieldName, hitID)
+	}
+
+	if m, ok := geomVal.(map[string]interface{}); ok {
+		if _, isShape := m["type"]; isShape {
+			geom, err = geoShapeFromGeoJSON(m)
+		} else {
+			var pt basic.Point
+			pt, err = geoPointFromValue(m)
+			geom = pt
+		}
+	} else {
+		var pt basic.Point
+		pt, err = geoPointFromValue(geomVal)
+		geom = pt
+	}
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	switch idv := source[plyr.IDFieldName].(type) {
+	case float64:
+		id = uint64(idv)
+	case string:
+		id, _ = strconv.ParseUint(idv, 10, 64)
+	default:
+		// Fall back to a hash of the elasticsearch document id.
+		for i := 0; i < len(hitID); i++ {
+			id = id*31 + uint64(hitID[i])
+		}
+	}
+
+	// tags carries the layer's default tags; every other _source field is
+	// exposed as a feature tag too, overriding a default of the same name.
+	ftags = make(map[string]interface{}, len(tags)+len(source))
+	for k, v := range tags {
+		ftags[k] = v
+	}
+	for k, v := range source {
+		if k == plyr.GeomFieldName || k == plyr.IDFieldName {
+			continue
+		}
+		ftags[k] = v
+	}
+
+	return geom, id, ftags, nil
+}
+
+// precisionByZoomFromConfig reads an optional precision_by_zoom table out of a
+// layer's raw config, e.g. {"0": 2, "8": 6, "14": 8}, keyed by zoom as a string
+// since that's how it comes in over TOML/JSON.
+func precisionByZoomFromConfig(vc dict.M) (map[int]int, error) {
+	raw, ok := vc[ConfigKeyPrecByZoom]
+	if !ok {
+		return nil, nil
+	}
+	m, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Expected %v to be a map of zoom to precision", ConfigKeyPrecByZoom)
+	}
+	out := make(map[int]int, len(m))
+	for k, v := range m {
+		zoom, err := strconv.Atoi(k)
+		if err != nil {
+			return nil, fmt.Errorf("Expected zoom key %v to be an integer: %v", k, err)
+		}
+		switch p := v.(type) {
+		case int:
+			out[zoom] = p
+		case int64:
+			out[zoom] = int(p)
+		case float64:
+			out[zoom] = int(p)
+		default:
+			return nil, fmt.Errorf("Expected precision for zoom %v to be a number, got %v", k, v)
+		}
+	}
+	return out, nil
+}
+
+// envelopeQuery returns the query that bounds a tile's search to its bbox.
+// geo_bounding_box is only valid against geo_point fields; geo_shape fields
+// have no equivalent query builder in the vendored olivere/elastic client, so
+// those get a hand-built envelope "intersects" filter instead, run through
+// RawStringQuery the same way buildQuery runs the sql config key's raw DSL.
+func envelopeQuery(plyr layer, minPt, maxPt *basic.Point) elastic.Query {
+	if plyr.GeomFieldType == GeomTypeGeoShape {
+		dsl := fmt.Sprintf(
+			`{"geo_shape":{%q:{"shape":{"type":"envelope","coordinates":[[%v,%v],[%v,%v]]},"relation":"intersects"}}}`,
+			plyr.GeomFieldName, minPt.X(), maxPt.Y(), maxPt.X(), minPt.Y(),
+		)
+		return elastic.NewRawStringQuery(dsl)
+	}
+	q := elastic.NewGeoBoundingBoxQuery(plyr.GeomFieldName)
+	q.TopRight(maxPt.Y(), maxPt.X())
+	q.BottomLeft(minPt.Y(), minPt.X())
+	return q
+}
+
+// bboxToken renders the tile envelope as the JSON fragment !BBOX! expands to,
+// shaped to match the real Query DSL for the layer's geometry_type: a
+// top_left/bottom_right object for geo_bounding_box (geo_point fields) or an
+// envelope coordinates array for geo_shape (geo_shape fields).
+func bboxToken(plyr layer, minPt, maxPt *basic.Point) string {
+	if plyr.GeomFieldType == GeomTypeGeoShape {
+		return fmt.Sprintf("[[%v,%v],[%v,%v]]", minPt.X(), maxPt.Y(), maxPt.X(), minPt.Y())
+	}
+	return fmt.Sprintf(
+		`{"top_left":{"lat":%v,"lon":%v},"bottom_right":{"lat":%v,"lon":%v}}`,
+		maxPt.Y(), minPt.X(), minPt.Y(), maxPt.X(),
+	)
+}
+
+// buildQuery combines the tile's envelope query with the layer's custom Query
+// DSL, if any. When plyr.SQL is set, its !BBOX! token is replaced with
+// bboxToken's rendering of the tile envelope and the resulting document is
+// run as a filter alongside the envelope query, the same way the postgis
+// provider treats custom SQL.
+func buildQuery(plyr layer, q elastic.Query, minPt, maxPt *basic.Point) elastic.Query {
+	if plyr.SQL == "" {
+		return q
+	}
+	dsl := strings.Replace(plyr.SQL, BBOX, bboxToken(plyr, minPt, maxPt), -1)
+	return elastic.NewBoolQuery().Filter(elastic.NewRawStringQuery(dsl), q)
+}
+
 func (p Provider) LayerNames() (names []string) {
 	for k, _ := range p.layers {
 		names = append(names, k)
@@ -181,51 +724,229 @@ func (p Provider) MVTLayer(layerName string, tile tegola.Tile, tags map[string]i
 		return nil, fmt.Errorf("Expected Point, got %t %v", maxGeo)
 	}
 
-	q := elastic.NewGeoBoundingBoxQuery("jobs")
-	q.TopRight(maxPt.Y(), maxPt.X())
-	q.BottomLeft(minPt.Y(), minPt.X())
-
-	client, err := elastic.NewClient(
-		elastic.SetURL("http://localhost:9200", "http://localhost:9201"),
-		elastic.SetMaxRetries(10))
-	//elastic.SetBasicAuth("user", "secret"))
+	query := buildQuery(plyr, envelopeQuery(plyr, minPt, maxPt), minPt, maxPt)
 
 	ctx := context.Background()
 
-	searchResult, err := client.Search().
-		Index("jobs"). // search in index "twitter"
-		Query(q).      // specify the query
-		Pretty(true).  // pretty print request and response JSON
-		Do(ctx)        // execute
-	if err != nil {
-		// Handle error
-		return nil, fmt.Errorf("Got the following error (%v) running query", err)
+	layer = new(mvt.Layer)
+	layer.Name = layerName
+
+	if plyr.Aggregation == AggregationGeohashGrid {
+		return p.geohashGridLayer(ctx, plyr, tile, query, layer)
 	}
 
-	// var geobytes []byte
+	// xThreshold/yThreshold turn SimplifyTolerance (in tile pixels) into
+	// world-unit thresholds against the tile's (already reprojected)
+	// envelope. The X and Y extents of a Web Mercator tile diverge in
+	// degrees away from the equator, so each axis needs its own threshold.
+	xThreshold := plyr.SimplifyTolerance * (maxPt.X() - minPt.X()) / TilePixels
+	yThreshold := plyr.SimplifyTolerance * (maxPt.Y() - minPt.Y()) / TilePixels
+
+	var searchAfter []interface{}
+	count := 0
+	for {
+		size := DefaultScrollSize
+		if plyr.MaxFeatures > 0 {
+			remaining := plyr.MaxFeatures - count
+			if remaining <= 0 {
+				break
+			}
+			if remaining < size {
+				size = remaining
+			}
+		}
+
+		svc := p.client.Search().
+			Index(plyr.IndexName). // search in the layer's configured index
+			Query(query).          // specify the query
+			Sort("_id", true).     // stable sort required by SearchAfter
+			Size(size)
+		if searchAfter != nil {
+			svc = svc.SearchAfter(searchAfter...)
+		}
 
-	layer = new(mvt.Layer)
-	layer.Name = layerName
-	var count int
-	// var didEnd bool
-	fmt.Printf("Query : %s\n", "Jobs")
-
-	if searchResult.Hits.TotalHits > 0 {
-		for _, hit := range searchResult.Hits.Hits {
-			var j Job
-			err := json.Unmarshal(*hit.Source, &j)
+		searchResult, err := svc.Do(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("Got the following error (%v) running query", err)
+		}
+
+		hits := searchResult.Hits.Hits
+		if len(hits) == 0 {
+			break
+		}
+
+		for _, hit := range hits {
+			var source map[string]interface{}
+			if err := json.Unmarshal(*hit.Source, &source); err != nil {
+				return nil, fmt.Errorf("Unable to decode _source for document %v in layer %v: %v", hit.Id, layerName, err)
+			}
+
+			geom, gid, ftags, err := decodeFeature(plyr, hit.Id, source, tags)
 			if err != nil {
-				// Deserialization failed
+				return nil, fmt.Errorf("Unable to decode document %v in layer %v: %v", hit.Id, layerName, err)
 			}
 
+			if shouldSimplifyAway(geom, plyr.SimplifyTolerance, xThreshold, yThreshold) {
+				continue
+			}
+
+			layer.AddFeatures(mvt.Feature{
+				ID:       &gid,
+				Tags:     ftags,
+				Geometry: geom,
+			})
 			count++
-			// var geom tegola.Geometry
-			// var gid uint64
+		}
 
-			// Work with tweet
-			fmt.Printf("Job : %s\n", j.Name)
+		searchAfter = hits[len(hits)-1].Sort
+		if len(hits) < size {
+			break
 		}
 	}
 
 	return layer, nil
 }
+
+// shouldSimplifyAway reports whether geom should be dropped from the tile
+// because its bbox is smaller than the tile's per-axis simplify threshold.
+// Points are never dropped, since they have no bbox to collapse.
+func shouldSimplifyAway(geom tegola.Geometry, tolerance, xThreshold, yThreshold float64) bool {
+	if tolerance <= 0 {
+		return false
+	}
+	if _, isPoint := geom.(basic.Point); isPoint {
+		return false
+	}
+	w, h := geometryBBoxSize(geom)
+	return w < xThreshold && h < yThreshold
+}
+
+// geometryBBoxSize returns the width and height, in the geometry's own units,
+// of geom's bounding box. Used to drop features smaller than a tile pixel
+// when SimplifyTolerance is set.
+func geometryBBoxSize(geom tegola.Geometry) (w, h float64) {
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+	found := false
+
+	extend := func(pt basic.Point) {
+		found = true
+		if pt.X() < minX {
+			minX = pt.X()
+		}
+		if pt.X() > maxX {
+			maxX = pt.X()
+		}
+		if pt.Y() < minY {
+			minY = pt.Y()
+		}
+		if pt.Y() > maxY {
+			maxY = pt.Y()
+		}
+	}
+
+	switch g := geom.(type) {
+	case basic.Point:
+		extend(g)
+	case basic.Line:
+		for _, pt := range g {
+			extend(pt)
+		}
+	case basic.Polygon:
+		for _, ln := range g {
+			for _, pt := range ln {
+				extend(pt)
+			}
+		}
+	case basic.MultiPoint:
+		for _, pt := range g {
+			extend(pt)
+		}
+	case basic.MultiLine:
+		for _, ln := range g {
+			for _, pt := range ln {
+				extend(pt)
+			}
+		}
+	case basic.MultiPolygon:
+		for _, poly := range g {
+			for _, ln := range poly {
+				for _, pt := range ln {
+					extend(pt)
+				}
+			}
+		}
+	}
+
+	if !found {
+		return 0, 0
+	}
+	return maxX - minX, maxY - minY
+}
+
+// geohashGridLayer issues a geohash_grid aggregation bounded by q and emits one
+// MVT feature per bucket, carrying a doc_count tag. The feature's geometry is
+// the point at the center of the bucket's geohash cell or, when plyr.GeoBounds
+// is set, the bbox polygon from a geo_bounds sub-aggregation. This lets a
+// dense index be rendered as a heat/cluster tile at low zoom instead of
+// fetching (and likely truncating) its raw hits.
+func (p Provider) geohashGridLayer(ctx context.Context, plyr layer, tile tegola.Tile, q elastic.Query, layer_ *mvt.Layer) (*mvt.Layer, error) {
+	precision := precisionForZoom(uint64(tile.Z), plyr.PrecisionByZoom)
+
+	agg := elastic.NewGeoHashGridAggregation().Field(plyr.GeomFieldName).Precision(precision)
+	if plyr.GeoBounds {
+		agg = agg.SubAggregation("bounds", elastic.NewGeoBoundsAggregation().Field(plyr.GeomFieldName))
+	}
+
+	searchResult, err := p.client.Search().
+		Index(plyr.IndexName).
+		Query(q).
+		Size(0).
+		Aggregation("grid", agg).
+		Do(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Got the following error (%v) running geohash_grid aggregation", err)
+	}
+
+	grid, found := searchResult.Aggregations.GeoHash("grid")
+	if !found {
+		return layer_, nil
+	}
+
+	for _, bucket := range grid.Buckets {
+		key, _ := bucket.Key.(string)
+
+		lat, lon, err := decodeGeohash(key)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to decode geohash bucket key %v: %v", key, err)
+		}
+
+		ftags := map[string]interface{}{"doc_count": bucket.DocCount}
+
+		var geom tegola.Geometry = basic.Point{lon, lat}
+		if plyr.GeoBounds {
+			if bounds, found := bucket.Aggregations.GeoBounds("bounds"); found {
+				geom = basic.Polygon{basic.Line{
+					basic.Point{bounds.Bounds.TopLeft.Longitude, bounds.Bounds.TopLeft.Latitude},
+					basic.Point{bounds.Bounds.BottomRight.Longitude, bounds.Bounds.TopLeft.Latitude},
+					basic.Point{bounds.Bounds.BottomRight.Longitude, bounds.Bounds.BottomRight.Latitude},
+					basic.Point{bounds.Bounds.TopLeft.Longitude, bounds.Bounds.BottomRight.Latitude},
+					basic.Point{bounds.Bounds.TopLeft.Longitude, bounds.Bounds.TopLeft.Latitude},
+				}}
+			}
+		}
+
+		var gid uint64
+		for i := 0; i < len(key); i++ {
+			gid = gid*31 + uint64(key[i])
+		}
+
+		layer_.AddFeatures(mvt.Feature{
+			ID:       &gid,
+			Tags:     ftags,
+			Geometry: geom,
+		})
+	}
+
+	return layer_, nil
+}
@@ -0,0 +1,241 @@
+package elasticsearch
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/terranodo/tegola"
+	"github.com/terranodo/tegola/basic"
+)
+
+func TestGeometryBBoxSize(t *testing.T) {
+	testcases := []struct {
+		geom tegola.Geometry
+		w, h float64
+	}{
+		{geom: basic.Point{1, 2}, w: 0, h: 0},
+		{
+			geom: basic.Line{basic.Point{0, 0}, basic.Point{3, 4}},
+			w:    3, h: 4,
+		},
+		{
+			geom: basic.Polygon{basic.Line{basic.Point{0, 0}, basic.Point{2, 0}, basic.Point{2, 5}, basic.Point{0, 5}}},
+			w:    2, h: 5,
+		},
+		{
+			geom: basic.MultiPoint{basic.Point{0, 0}, basic.Point{-1, 3}},
+			w:    1, h: 3,
+		},
+	}
+
+	for i, tc := range testcases {
+		w, h := geometryBBoxSize(tc.geom)
+		if !floatsClose(w, tc.w, 1e-9) || !floatsClose(h, tc.h, 1e-9) {
+			t.Errorf("testcase (%v) failed. got (%v,%v) expected (%v,%v)", i, w, h, tc.w, tc.h)
+		}
+	}
+}
+
+func TestShouldSimplifyAway(t *testing.T) {
+	line := basic.Line{basic.Point{0, 0}, basic.Point{1, 1}}
+	point := basic.Point{0, 0}
+
+	testcases := []struct {
+		name                string
+		geom                tegola.Geometry
+		tolerance           float64
+		xThreshold, yThresh float64
+		want                bool
+	}{
+		{name: "tolerance disabled", geom: line, tolerance: 0, xThreshold: 10, yThresh: 10, want: false},
+		{name: "points are never dropped", geom: point, tolerance: 5, xThreshold: 10, yThresh: 10, want: false},
+		{name: "bbox smaller than both thresholds", geom: line, tolerance: 5, xThreshold: 10, yThresh: 10, want: true},
+		{name: "bbox as big as x threshold", geom: line, tolerance: 5, xThreshold: 1, yThresh: 10, want: false},
+		{name: "bbox as big as y threshold", geom: line, tolerance: 5, xThreshold: 10, yThresh: 1, want: false},
+	}
+
+	for _, tc := range testcases {
+		got := shouldSimplifyAway(tc.geom, tc.tolerance, tc.xThreshold, tc.yThresh)
+		if got != tc.want {
+			t.Errorf("%v: got %v, expected %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestGeoPointFromValue(t *testing.T) {
+	testcases := []struct {
+		value interface{}
+		point basic.Point
+	}{
+		{
+			value: []interface{}{-71.34, 41.12},
+			point: basic.Point{-71.34, 41.12},
+		},
+		{
+			value: map[string]interface{}{"lat": 41.12, "lon": -71.34},
+			point: basic.Point{-71.34, 41.12},
+		},
+		{
+			value: "41.12,-71.34",
+			point: basic.Point{-71.34, 41.12},
+		},
+		{
+			value: "drm3btev3e86",
+			point: basic.Point{-71.34000012651086, 41.12000000663102},
+		},
+	}
+
+	for i, tc := range testcases {
+		pt, err := geoPointFromValue(tc.value)
+		if err != nil {
+			t.Errorf("testcase (%v) failed. err: %v", i, err)
+			continue
+		}
+		if !pointsClose(pt, tc.point, 1e-6) {
+			t.Errorf("testcase (%v) failed. got %v expected %v", i, pt, tc.point)
+		}
+	}
+}
+
+func TestGeoPointFromValueErrors(t *testing.T) {
+	testcases := []interface{}{
+		42,
+		[]interface{}{1.0},
+		map[string]interface{}{"lat": "not a number", "lon": -71.34},
+	}
+
+	for i, v := range testcases {
+		if _, err := geoPointFromValue(v); err == nil {
+			t.Errorf("testcase (%v) expected an error, got nil for %v", i, v)
+		}
+	}
+}
+
+func TestDecodeGeohash(t *testing.T) {
+	testcases := []struct {
+		hash string
+		lat  float64
+		lon  float64
+	}{
+		{hash: "drm3btev3e86", lat: 41.12000000663102, lon: -71.34000012651086},
+		{hash: "s00000000000", lat: 8.381903171539307e-08, lon: 1.6763806343078613e-07},
+	}
+
+	for i, tc := range testcases {
+		lat, lon, err := decodeGeohash(tc.hash)
+		if err != nil {
+			t.Errorf("testcase (%v) failed. err: %v", i, err)
+			continue
+		}
+		if !floatsClose(lat, tc.lat, 1e-6) || !floatsClose(lon, tc.lon, 1e-6) {
+			t.Errorf("testcase (%v) failed. got (%v,%v) expected (%v,%v)", i, lat, lon, tc.lat, tc.lon)
+		}
+	}
+
+	if _, _, err := decodeGeohash("!!!"); err == nil {
+		t.Error("expected an error decoding an invalid geohash, got nil")
+	}
+}
+
+func TestGeoShapeFromGeoJSON(t *testing.T) {
+	testcases := []struct {
+		doc  map[string]interface{}
+		geom interface{}
+	}{
+		{
+			doc: map[string]interface{}{
+				"type":        "Point",
+				"coordinates": []interface{}{-71.34, 41.12},
+			},
+			geom: basic.Point{-71.34, 41.12},
+		},
+		{
+			doc: map[string]interface{}{
+				"type": "LineString",
+				"coordinates": []interface{}{
+					[]interface{}{-71.34, 41.12},
+					[]interface{}{-71.35, 41.13},
+				},
+			},
+			geom: basic.Line{basic.Point{-71.34, 41.12}, basic.Point{-71.35, 41.13}},
+		},
+		{
+			doc: map[string]interface{}{
+				"type": "Polygon",
+				"coordinates": []interface{}{
+					[]interface{}{
+						[]interface{}{-71.34, 41.12},
+						[]interface{}{-71.35, 41.13},
+						[]interface{}{-71.36, 41.14},
+					},
+				},
+			},
+			geom: basic.Polygon{basic.Line{basic.Point{-71.34, 41.12}, basic.Point{-71.35, 41.13}, basic.Point{-71.36, 41.14}}},
+		},
+	}
+
+	for i, tc := range testcases {
+		geom, err := geoShapeFromGeoJSON(tc.doc)
+		if err != nil {
+			t.Errorf("testcase (%v) failed. err: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(geom, tc.geom) {
+			t.Errorf("testcase (%v) failed. got %#v expected %#v", i, geom, tc.geom)
+		}
+	}
+}
+
+func TestGeoShapeFromGeoJSONUnknownType(t *testing.T) {
+	_, err := geoShapeFromGeoJSON(map[string]interface{}{"type": "GeometryCollection"})
+	if err == nil {
+		t.Error("expected an error for an unsupported geo_shape type, got nil")
+	}
+}
+
+func TestDecodeFeatureTagMerge(t *testing.T) {
+	plyr := layer{GeomFieldName: "geom", IDFieldName: "gid"}
+
+	source := map[string]interface{}{
+		"geom": []interface{}{-71.34, 41.12},
+		"gid":  float64(7),
+		"name": "source value",
+		"city": "providence",
+	}
+	defaultTags := map[string]interface{}{
+		"name":  "default value",
+		"layer": "points",
+	}
+
+	_, id, ftags, err := decodeFeature(plyr, "7", source, defaultTags)
+	if err != nil {
+		t.Fatalf("decodeFeature failed. err: %v", err)
+	}
+	if id != 7 {
+		t.Errorf("got id %v, expected 7", id)
+	}
+
+	// A _source field should win over a default tag of the same name, and
+	// every other _source field should be exposed as a tag too — not just
+	// the ones that happen to already be in the defaults.
+	expected := map[string]interface{}{
+		"name":  "source value",
+		"layer": "points",
+		"city":  "providence",
+	}
+	if !reflect.DeepEqual(ftags, expected) {
+		t.Errorf("got tags %#v, expected %#v", ftags, expected)
+	}
+}
+
+func pointsClose(a, b basic.Point, eps float64) bool {
+	return floatsClose(a.X(), b.X(), eps) && floatsClose(a.Y(), b.Y(), eps)
+}
+
+func floatsClose(a, b, eps float64) bool {
+	d := a - b
+	if d < 0 {
+		d = -d
+	}
+	return d <= eps
+}